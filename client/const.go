@@ -0,0 +1,174 @@
+package client
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	handshakeCommand       = "handshake"
+	eventCommand           = "event"
+	forceLeaveCommand      = "force-leave"
+	joinCommand            = "join"
+	membersCommand         = "members"
+	membersFilteredCommand = "members-filtered"
+	streamCommand          = "stream"
+	monitorCommand         = "monitor"
+	monitorJSONCommand     = "monitor-json"
+	stopCommand            = "stop"
+	leaveCommand           = "leave"
+	tagsCommand            = "tags"
+	queryCommand           = "query"
+	respondCommand         = "respond"
+	authCommand            = "auth"
+	cancelCommand          = "cancel"
+)
+
+// unsupportedIPCVersion is returned by the agent when the version requested
+// in a handshake is higher than anything it knows how to speak.
+const unsupportedIPCVersion = "Unsupported IPC version"
+
+// maxIPCVersion is the maximum IPC version this client knows how to speak.
+// Version 2 added the monitor-json command for structured log streaming.
+const maxIPCVersion = 2
+
+// msgType distinguishes how a frame on the wire should be interpreted: a
+// request awaiting a response, a response to an earlier request, or a
+// fire-and-forget notification that expects no reply. It defaults to
+// msgTypeRequest so existing call sites that never set it keep their
+// original meaning.
+type msgType uint8
+
+const (
+	msgTypeRequest msgType = iota
+	msgTypeResponse
+	msgTypeNotification
+)
+
+// requestHeader is sent before each request
+type requestHeader struct {
+	Command string
+	Seq     uint64
+	Type    msgType
+}
+
+// responseHeader is sent before each response. When Type is
+// msgTypeNotification, Method carries the "Namespace.Method" name the agent
+// is invoking on the client and Error is unused.
+type responseHeader struct {
+	Seq    uint64
+	Error  string
+	Type   msgType
+	Method string
+}
+
+type handshakeRequest struct {
+	Version int32
+}
+
+type authRequest struct {
+	AuthKey string
+}
+
+type forceLeaveRequest struct {
+	Node string
+}
+
+type joinRequest struct {
+	Existing []string
+	Replay   bool
+}
+
+type joinResponse struct {
+	Num uint32
+}
+
+// Member represents a single member of the Serf cluster
+type Member struct {
+	Name        string
+	Addr        net.IP
+	Port        uint16
+	Tags        map[string]string
+	Status      string
+	ProtocolMin uint8
+	ProtocolMax uint8
+	ProtocolCur uint8
+	DelegateMin uint8
+	DelegateMax uint8
+	DelegateCur uint8
+}
+
+type membersRequest struct {
+	Tags   map[string]string
+	Status string
+}
+
+type membersResponse struct {
+	Members []Member
+}
+
+type eventRequest struct {
+	Name     string
+	Payload  []byte
+	Coalesce bool
+}
+
+type tagsRequest struct {
+	Tags       map[string]string
+	DeleteTags []string
+}
+
+type monitorRequest struct {
+	LogLevel string
+}
+
+// monitorJSONRequest is sent for monitorJSONCommand. The agent attaches an
+// intercepting hclog JSON sink at LogLevel, independent of its own global log
+// level, so multiple concurrent monitors at different verbosities don't
+// interfere with one another.
+type monitorJSONRequest struct {
+	LogLevel       string
+	IncludeModules []string
+	RateLimit      time.Duration
+}
+
+type logRecord struct {
+	Log string
+}
+
+type streamRequest struct {
+	Type string
+}
+
+type stopRequest struct {
+	Stop uint64
+}
+
+type queryRequest struct {
+	FilterNodes []string
+	FilterTags  map[string]string
+	RequestAck  bool
+	RelayFactor uint8
+	Timeout     time.Duration
+	Name        string
+	Payload     []byte
+}
+
+// queryRecord is streamed back on the seq of a query request, demultiplexing
+// the acks, responses, and final done marker that make up a query's results.
+type queryRecord struct {
+	Type    string // "ack", "response", or "done"
+	From    string
+	Payload []byte
+}
+
+type respondRequest struct {
+	ID      uint64
+	Payload []byte
+}
+
+// cancelRequest is sent as a notification to ask the agent to stop the
+// long-running work backing Seq (a query, monitor, or join), best-effort.
+type cancelRequest struct {
+	Seq uint64
+}
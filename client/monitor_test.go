@@ -0,0 +1,49 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogRecord(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want *LogRecord
+	}{
+		{
+			name: "well formed hclog JSON",
+			raw:  `{"@timestamp":"2020-01-02T15:04:05Z","@level":"info","@module":"agent","@message":"joined","peer":"10.0.0.1"}`,
+			want: &LogRecord{
+				Timestamp: "2020-01-02T15:04:05Z",
+				Level:     "info",
+				Module:    "agent",
+				Message:   "joined",
+				Fields:    map[string]interface{}{"peer": "10.0.0.1"},
+			},
+		},
+		{
+			name: "non-JSON line falls back to the raw message",
+			raw:  "plain text log line",
+			want: &LogRecord{
+				Message: "plain text log line",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseLogRecord(tc.raw)
+			if string(got.Raw) != tc.raw {
+				t.Errorf("Raw = %q, want %q", got.Raw, tc.raw)
+			}
+			if got.Timestamp != tc.want.Timestamp || got.Level != tc.want.Level ||
+				got.Module != tc.want.Module || got.Message != tc.want.Message {
+				t.Errorf("parsed fields = %+v, want %+v", got, tc.want)
+			}
+			if !reflect.DeepEqual(got.Fields, tc.want.Fields) {
+				t.Errorf("Fields = %#v, want %#v", got.Fields, tc.want.Fields)
+			}
+		})
+	}
+}
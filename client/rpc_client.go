@@ -2,13 +2,19 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/logutils"
 	"github.com/ugorji/go/codec"
 	"log"
 	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -22,11 +28,16 @@ type seqCallback struct {
 func (sc *seqCallback) Handle(resp *responseHeader) {
 	sc.handler(resp)
 }
+
+// Cancel is a no-op for seqCallback: genericRPCContext's handler deregisters
+// itself the moment it actually runs, so there is nothing extra to mark.
+func (sc *seqCallback) Cancel()  {}
 func (sc *seqCallback) Cleanup() {}
 
 // seqHandler interface is used to handle responses
 type seqHandler interface {
 	Handle(*responseHeader)
+	Cancel()
 	Cleanup()
 }
 
@@ -36,7 +47,7 @@ type seqHandler interface {
 type RPCClient struct {
 	seq uint64
 
-	conn      *net.TCPConn
+	conn      net.Conn
 	reader    *bufio.Reader
 	writer    *bufio.Writer
 	dec       *codec.Decoder
@@ -46,6 +57,13 @@ type RPCClient struct {
 	dispatch     map[uint64]seqHandler
 	dispatchLock sync.Mutex
 
+	services    map[string]map[string]*rpcMethod
+	serviceLock sync.Mutex
+
+	// remoteIPCVersion is the IPC version negotiated with the agent during
+	// the handshake. It gates use of newer commands like monitor-json.
+	remoteIPCVersion int
+
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -78,12 +96,64 @@ func (c *RPCClient) send(header *requestHeader, obj interface{}) error {
 	return nil
 }
 
-// NewRPCClient is used to create a new RPC client given the
-// RPC address of the Serf agent. This will return a client,
-// or an error if the connection could not be established.
-func NewRPCClient(addr string) (*RPCClient, error) {
-	// Try to dial to serf
-	conn, err := net.Dial("tcp", addr)
+// Config is used to configure the transport used by ClientFromConfig. It
+// generalizes the plain TCP connection that NewRPCClient makes to also
+// support Unix domain sockets, TLS, and mutual TLS.
+type Config struct {
+	// Addr is the address of the Serf agent's RPC listener.
+	Addr string
+
+	// Network is the network to dial, "tcp" or "unix". Defaults to "tcp".
+	Network string
+
+	// AuthKey, if set, is sent to the agent right after the handshake to
+	// authenticate the connection.
+	AuthKey string
+
+	// TLSConfig, if set, wraps the connection in TLS. Setting a client
+	// certificate in Certificates enables mutual TLS.
+	TLSConfig *tls.Config
+
+	// Timeout is the dial timeout. Defaults to no timeout.
+	Timeout time.Duration
+
+	// Dialer, if set, is used in place of the default net.Dialer to
+	// establish the connection; Network and Addr are passed through
+	// unchanged.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dial establishes the raw connection described by the config, wrapping it
+// in TLS when a TLSConfig is set.
+func (c *Config) dial(ctx context.Context) (net.Conn, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	dial := c.Dialer
+	if dial == nil {
+		d := &net.Dialer{Timeout: c.Timeout}
+		dial = d.DialContext
+	}
+
+	conn, err := dial(ctx, network, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLSConfig != nil {
+		conn = tls.Client(conn, c.TLSConfig)
+	}
+	return conn, nil
+}
+
+// ClientFromConfig is used to create a new RPC client using a Config,
+// allowing the transport (TCP, Unix socket, TLS) and auth key to be
+// configured. This will return a client, or an error if the connection could
+// not be established.
+func ClientFromConfig(config *Config) (*RPCClient, error) {
+	conn, err := config.dial(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +161,7 @@ func NewRPCClient(addr string) (*RPCClient, error) {
 	// Create the client
 	client := &RPCClient{
 		seq:        0,
-		conn:       conn.(*net.TCPConn),
+		conn:       conn,
 		reader:     bufio.NewReader(conn),
 		writer:     bufio.NewWriter(conn),
 		dispatch:   make(map[uint64]seqHandler),
@@ -108,7 +178,26 @@ func NewRPCClient(addr string) (*RPCClient, error) {
 		client.Close()
 		return nil, err
 	}
-	return client, err
+
+	// Authenticate, if configured
+	if config.AuthKey != "" {
+		if err := client.auth(config.AuthKey); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// NewRPCClient is used to create a new RPC client given the
+// RPC address of the Serf agent. This will return a client,
+// or an error if the connection could not be established.
+func NewRPCClient(addr string) (*RPCClient, error) {
+	return ClientFromConfig(&Config{
+		Addr:    addr,
+		Network: "tcp",
+	})
 }
 
 // StreamHandle is an opaque handle passed to stop to stop streaming
@@ -131,6 +220,11 @@ func (c *RPCClient) Close() error {
 // ForceLeave is used to ask the agent to issue a leave command for
 // a given node
 func (c *RPCClient) ForceLeave(node string) error {
+	return c.ForceLeaveContext(context.Background(), node)
+}
+
+// ForceLeaveContext is ForceLeave, honoring ctx's cancellation and deadline.
+func (c *RPCClient) ForceLeaveContext(ctx context.Context, node string) error {
 	header := requestHeader{
 		Command: forceLeaveCommand,
 		Seq:     c.getSeq(),
@@ -138,11 +232,16 @@ func (c *RPCClient) ForceLeave(node string) error {
 	req := forceLeaveRequest{
 		Node: node,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // Join is used to instruct the agent to attempt a join
 func (c *RPCClient) Join(addrs []string, replay bool) (int, error) {
+	return c.JoinContext(context.Background(), addrs, replay)
+}
+
+// JoinContext is Join, honoring ctx's cancellation and deadline.
+func (c *RPCClient) JoinContext(ctx context.Context, addrs []string, replay bool) (int, error) {
 	header := requestHeader{
 		Command: joinCommand,
 		Seq:     c.getSeq(),
@@ -153,24 +252,35 @@ func (c *RPCClient) Join(addrs []string, replay bool) (int, error) {
 	}
 	var resp joinResponse
 
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 	return int(resp.Num), err
 }
 
 // Members is used to fetch a list of known members
 func (c *RPCClient) Members() ([]Member, error) {
+	return c.MembersContext(context.Background())
+}
+
+// MembersContext is Members, honoring ctx's cancellation and deadline.
+func (c *RPCClient) MembersContext(ctx context.Context) ([]Member, error) {
 	header := requestHeader{
 		Command: membersCommand,
 		Seq:     c.getSeq(),
 	}
 	var resp membersResponse
 
-	err := c.genericRPC(&header, nil, &resp)
+	err := c.genericRPCContext(ctx, &header, nil, &resp)
 	return resp.Members, err
 }
 
 // MembersFiltered returns a subset of members filtered by tags or status
 func (c *RPCClient) MembersFiltered(tags map[string]string, status string) ([]Member, error) {
+	return c.MembersFilteredContext(context.Background(), tags, status)
+}
+
+// MembersFilteredContext is MembersFiltered, honoring ctx's cancellation and
+// deadline.
+func (c *RPCClient) MembersFilteredContext(ctx context.Context, tags map[string]string, status string) ([]Member, error) {
 	header := requestHeader{
 		Command: membersFilteredCommand,
 		Seq:     c.getSeq(),
@@ -181,12 +291,17 @@ func (c *RPCClient) MembersFiltered(tags map[string]string, status string) ([]Me
 	}
 	var resp membersResponse
 
-	err := c.genericRPC(&header, &req, &resp)
+	err := c.genericRPCContext(ctx, &header, &req, &resp)
 	return resp.Members, err
 }
 
 // UserEvent is used to trigger sending an event
 func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error {
+	return c.UserEventContext(context.Background(), name, payload, coalesce)
+}
+
+// UserEventContext is UserEvent, honoring ctx's cancellation and deadline.
+func (c *RPCClient) UserEventContext(ctx context.Context, name string, payload []byte, coalesce bool) error {
 	header := requestHeader{
 		Command: eventCommand,
 		Seq:     c.getSeq(),
@@ -196,20 +311,30 @@ func (c *RPCClient) UserEvent(name string, payload []byte, coalesce bool) error
 		Payload:  payload,
 		Coalesce: coalesce,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
 // Leave is used to trigger a graceful leave and shutdown of the agent
 func (c *RPCClient) Leave() error {
+	return c.LeaveContext(context.Background())
+}
+
+// LeaveContext is Leave, honoring ctx's cancellation and deadline.
+func (c *RPCClient) LeaveContext(ctx context.Context) error {
 	header := requestHeader{
 		Command: leaveCommand,
 		Seq:     c.getSeq(),
 	}
-	return c.genericRPC(&header, nil, nil)
+	return c.genericRPCContext(ctx, &header, nil, nil)
 }
 
 // UpdateTags will modify the tags on a running serf agent
 func (c *RPCClient) UpdateTags(tags map[string]string, delTags []string) error {
+	return c.UpdateTagsContext(context.Background(), tags, delTags)
+}
+
+// UpdateTagsContext is UpdateTags, honoring ctx's cancellation and deadline.
+func (c *RPCClient) UpdateTagsContext(ctx context.Context, tags map[string]string, delTags []string) error {
 	header := requestHeader{
 		Command: tagsCommand,
 		Seq:     c.getSeq(),
@@ -218,16 +343,127 @@ func (c *RPCClient) UpdateTags(tags map[string]string, delTags []string) error {
 		Tags:       tags,
 		DeleteTags: delTags,
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// rpcMethod describes a single exported method of a service registered via
+// RegisterName, bound to its receiver so it can be invoked by reflection.
+type rpcMethod struct {
+	receiver reflect.Value
+	method   reflect.Method
+	argType  reflect.Type
+}
+
+// RegisterName exposes the exported methods of service under namespace so the
+// agent can invoke them by sending a notification addressed to
+// "namespace.Method". Each exposed method must have the signature
+// func(ctx context.Context, args *ArgType) error; methods that don't match
+// are ignored.
+func (c *RPCClient) RegisterName(namespace string, service interface{}) error {
+	rv := reflect.ValueOf(service)
+	rt := rv.Type()
+
+	ctxType := reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+
+	methods := make(map[string]*rpcMethod)
+	for i := 0; i < rt.NumMethod(); i++ {
+		method := rt.Method(i)
+		mt := method.Type
+		if mt.NumIn() != 3 || mt.NumOut() != 1 {
+			continue
+		}
+		if mt.In(1) != ctxType || mt.In(2).Kind() != reflect.Ptr || mt.Out(0) != errType {
+			continue
+		}
+		methods[method.Name] = &rpcMethod{
+			receiver: rv,
+			method:   method,
+			argType:  mt.In(2),
+		}
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("client: service %q exposes no usable methods", namespace)
+	}
+
+	c.serviceLock.Lock()
+	defer c.serviceLock.Unlock()
+	if c.services == nil {
+		c.services = make(map[string]map[string]*rpcMethod)
+	}
+	c.services[namespace] = methods
+	return nil
+}
+
+// Notify sends a fire-and-forget message to the agent. Unlike the other
+// RPCClient methods, Notify does not wait for or expect a response.
+func (c *RPCClient) Notify(method string, args interface{}) error {
+	header := requestHeader{
+		Command: method,
+		Seq:     c.getSeq(),
+		Type:    msgTypeNotification,
+	}
+	return c.send(&header, args)
+}
+
+// dispatchNotification routes an inbound notification from the agent to a
+// method registered via RegisterName, decoding its arguments with the client
+// codec before handing off to the handler.
+func (c *RPCClient) dispatchNotification(header *responseHeader) {
+	namespace, name := splitMethod(header.Method)
+
+	c.serviceLock.Lock()
+	methods := c.services[namespace]
+	c.serviceLock.Unlock()
+
+	var m *rpcMethod
+	if methods != nil {
+		m = methods[name]
+	}
+	if m == nil {
+		// Still consume the args payload the agent sent for this
+		// notification, even though nothing is registered to handle it, so
+		// the shared decoder stream stays aligned for subsequent reads.
+		var discard interface{}
+		if err := c.dec.Decode(&discard); err != nil {
+			log.Printf("[ERR] agent.client: Failed to discard notification args for %q: %v", header.Method, err)
+		}
+		log.Printf("[ERR] agent.client: No handler registered for %q", header.Method)
+		return
+	}
+
+	argv := reflect.New(m.argType.Elem())
+	if err := c.dec.Decode(argv.Interface()); err != nil {
+		log.Printf("[ERR] agent.client: Failed to decode notification args for %q: %v", header.Method, err)
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		out := m.method.Func.Call([]reflect.Value{m.receiver, reflect.ValueOf(ctx), argv})
+		if err, _ := out[0].Interface().(error); err != nil {
+			log.Printf("[ERR] agent.client: Handler for %q returned an error: %v", header.Method, err)
+		}
+	}()
+}
+
+// splitMethod splits a "Namespace.Method" string into its two parts.
+func splitMethod(s string) (string, string) {
+	idx := strings.LastIndex(s, ".")
+	if idx < 0 {
+		return "", s
+	}
+	return s[:idx], s[idx+1:]
 }
 
 type monitorHandler struct {
-	client *RPCClient
-	closed bool
-	init   bool
-	initCh chan<- error
-	logCh  chan<- string
-	seq    uint64
+	client    *RPCClient
+	closed    bool
+	init      bool
+	cancelled int32
+	initCh    chan<- error
+	logCh     chan<- string
+	seq       uint64
 }
 
 func (mh *monitorHandler) Handle(resp *responseHeader) {
@@ -238,13 +474,18 @@ func (mh *monitorHandler) Handle(resp *responseHeader) {
 		return
 	}
 
-	// Decode logs for all other responses
+	// Decode logs for all other responses. This always has to run, even once
+	// cancelled, so a log line the agent had already queued before it saw our
+	// cancel notification is still pulled off the shared decoder.
 	var rec logRecord
 	if err := mh.client.dec.Decode(&rec); err != nil {
 		log.Printf("[ERR] Failed to decode log: %v", err)
 		mh.client.deregisterHandler(mh.seq)
 		return
 	}
+	if atomic.LoadInt32(&mh.cancelled) == 1 {
+		return
+	}
 	select {
 	case mh.logCh <- rec.Log:
 	default:
@@ -252,6 +493,13 @@ func (mh *monitorHandler) Handle(resp *responseHeader) {
 	}
 }
 
+// Cancel marks the handler as abandoned: later frames addressed to its seq
+// are still decoded to keep the shared decoder in sync, but are no longer
+// delivered to logCh.
+func (mh *monitorHandler) Cancel() {
+	atomic.StoreInt32(&mh.cancelled, 1)
+}
+
 func (mh *monitorHandler) Cleanup() {
 	if !mh.closed {
 		if !mh.init {
@@ -265,6 +513,12 @@ func (mh *monitorHandler) Cleanup() {
 
 // Monitor is used to subscribe to the logs of the agent
 func (c *RPCClient) Monitor(level logutils.LogLevel, ch chan<- string) (StreamHandle, error) {
+	return c.MonitorContext(context.Background(), level, ch)
+}
+
+// MonitorContext is Monitor, honoring ctx's cancellation and deadline while
+// waiting for the agent to acknowledge the subscription.
+func (c *RPCClient) MonitorContext(ctx context.Context, level logutils.LogLevel, ch chan<- string) (StreamHandle, error) {
 	// Setup the request
 	seq := c.getSeq()
 	header := requestHeader{
@@ -292,22 +546,211 @@ func (c *RPCClient) Monitor(level logutils.LogLevel, ch chan<- string) (StreamHa
 	}
 
 	// Wait for a response
+	if err := c.waitInit(ctx, seq, handler, initCh); err != nil {
+		return 0, err
+	}
+	return StreamHandle(seq), nil
+}
+
+// MonitorOpts are used to configure a call to MonitorWithOptions.
+type MonitorOpts struct {
+	// LogLevel is the minimum level of log record to receive.
+	LogLevel logutils.LogLevel
+
+	// LogJSON requests structured hclog JSON records instead of plaintext
+	// lines. It is ignored (falls back to plaintext) when talking to an
+	// agent that only negotiated IPC version 1.
+	LogJSON bool
+
+	// IncludeModules restricts records to the given hclog module names. A
+	// nil or empty slice means all modules are included. It is only sent on
+	// the monitor-json path; the plaintext path does not filter by module.
+	IncludeModules []string
+
+	// RateLimit, if non-zero, asks the agent to forward at most one record
+	// per interval, dropping the rest. It is only sent on the monitor-json
+	// path; the plaintext path is not rate limited.
+	RateLimit time.Duration
+}
+
+// LogRecord is a single log record streamed back from MonitorWithOptions.
+// Raw always holds the record exactly as received; the remaining fields are
+// populated by parsing Raw as hclog JSON. When LogJSON wasn't used or parsing
+// fails, Message holds the raw line and the other fields are zero-valued.
+type LogRecord struct {
+	Raw       []byte
+	Timestamp string
+	Level     string
+	Module    string
+	Message   string
+	Fields    map[string]interface{}
+}
+
+type monitorJSONHandler struct {
+	client    *RPCClient
+	closed    bool
+	init      bool
+	cancelled int32
+	initCh    chan<- error
+	logCh     chan<- *LogRecord
+	seq       uint64
+}
+
+func (mh *monitorJSONHandler) Handle(resp *responseHeader) {
+	// Initialize on the first response
+	if !mh.init {
+		mh.init = true
+		mh.initCh <- strToError(resp.Error)
+		return
+	}
+
+	// Decode logs for all other responses. This always has to run, even once
+	// cancelled, so a log line the agent had already queued before it saw our
+	// cancel notification is still pulled off the shared decoder.
+	var rec logRecord
+	if err := mh.client.dec.Decode(&rec); err != nil {
+		log.Printf("[ERR] Failed to decode log: %v", err)
+		mh.client.deregisterHandler(mh.seq)
+		return
+	}
+	if atomic.LoadInt32(&mh.cancelled) == 1 {
+		return
+	}
 	select {
-	case err := <-initCh:
-		return StreamHandle(seq), err
-	case <-c.shutdownCh:
+	case mh.logCh <- parseLogRecord(rec.Log):
+	default:
+		log.Printf("[ERR] Dropping log! Monitor channel full")
+	}
+}
+
+// Cancel marks the handler as abandoned: later frames addressed to its seq
+// are still decoded to keep the shared decoder in sync, but are no longer
+// delivered to logCh.
+func (mh *monitorJSONHandler) Cancel() {
+	atomic.StoreInt32(&mh.cancelled, 1)
+}
+
+func (mh *monitorJSONHandler) Cleanup() {
+	if !mh.closed {
+		if !mh.init {
+			mh.init = true
+			mh.initCh <- fmt.Errorf("Stream closed")
+		}
+		close(mh.logCh)
+		mh.closed = true
+	}
+}
+
+// parseLogRecord parses a raw hclog JSON log line into a LogRecord. If raw
+// isn't valid JSON, the record is returned with only Raw and Message set, so
+// callers always get something usable.
+func parseLogRecord(raw string) *LogRecord {
+	rec := &LogRecord{Raw: []byte(raw), Message: raw}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return rec
+	}
+
+	if v, ok := fields["@timestamp"].(string); ok {
+		rec.Timestamp = v
+		delete(fields, "@timestamp")
+	}
+	if v, ok := fields["@level"].(string); ok {
+		rec.Level = v
+		delete(fields, "@level")
+	}
+	if v, ok := fields["@module"].(string); ok {
+		rec.Module = v
+		delete(fields, "@module")
+	}
+	if v, ok := fields["@message"].(string); ok {
+		rec.Message = v
+		delete(fields, "@message")
+	}
+	rec.Fields = fields
+	return rec
+}
+
+// MonitorWithOptions is used to subscribe to the logs of the agent with
+// finer-grained control than Monitor: structured hclog JSON records,
+// module filtering, and a per-message rate limit. When LogJSON is unset or
+// the agent only negotiated IPC version 1, it falls back to the plaintext
+// Monitor path, which honors only LogLevel, and wraps each line in a
+// LogRecord.
+func (c *RPCClient) MonitorWithOptions(opts MonitorOpts) (StreamHandle, <-chan *LogRecord, error) {
+	return c.MonitorWithOptionsContext(context.Background(), opts)
+}
+
+// MonitorWithOptionsContext is MonitorWithOptions, honoring ctx's
+// cancellation and deadline while waiting for the agent to acknowledge the
+// subscription.
+func (c *RPCClient) MonitorWithOptionsContext(ctx context.Context, opts MonitorOpts) (StreamHandle, <-chan *LogRecord, error) {
+	if !opts.LogJSON || c.remoteIPCVersion < 2 {
+		plainCh := make(chan string, 256)
+		handle, err := c.MonitorContext(ctx, opts.LogLevel, plainCh)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		logCh := make(chan *LogRecord, 256)
+		go func() {
+			defer close(logCh)
+			for line := range plainCh {
+				select {
+				case logCh <- &LogRecord{Raw: []byte(line), Message: line}:
+				default:
+					log.Printf("[ERR] Dropping log! Monitor channel full")
+				}
+			}
+		}()
+		return handle, logCh, nil
+	}
+
+	// Setup the request
+	seq := c.getSeq()
+	header := requestHeader{
+		Command: monitorJSONCommand,
+		Seq:     seq,
+	}
+	req := monitorJSONRequest{
+		LogLevel:       string(opts.LogLevel),
+		IncludeModules: opts.IncludeModules,
+		RateLimit:      opts.RateLimit,
+	}
+
+	// Create a monitor handler
+	initCh := make(chan error, 1)
+	logCh := make(chan *LogRecord, 256)
+	handler := &monitorJSONHandler{
+		client: c,
+		initCh: initCh,
+		logCh:  logCh,
+		seq:    seq,
+	}
+	c.handleSeq(seq, handler)
+
+	// Send the request
+	if err := c.send(&header, &req); err != nil {
 		c.deregisterHandler(seq)
-		return 0, clientClosed
+		return 0, nil, err
+	}
+
+	// Wait for a response
+	if err := c.waitInit(ctx, seq, handler, initCh); err != nil {
+		return 0, nil, err
 	}
+	return StreamHandle(seq), logCh, nil
 }
 
 type streamHandler struct {
-	client  *RPCClient
-	closed  bool
-	init    bool
-	initCh  chan<- error
-	eventCh chan<- map[string]interface{}
-	seq     uint64
+	client    *RPCClient
+	closed    bool
+	init      bool
+	cancelled int32
+	initCh    chan<- error
+	eventCh   chan<- map[string]interface{}
+	seq       uint64
 }
 
 func (sh *streamHandler) Handle(resp *responseHeader) {
@@ -318,13 +761,18 @@ func (sh *streamHandler) Handle(resp *responseHeader) {
 		return
 	}
 
-	// Decode logs for all other responses
+	// Decode events for all other responses. This always has to run, even
+	// once cancelled, so an event the agent had already queued before it saw
+	// our cancel notification is still pulled off the shared decoder.
 	var rec map[string]interface{}
 	if err := sh.client.dec.Decode(&rec); err != nil {
 		log.Printf("[ERR] Failed to decode stream record: %v", err)
 		sh.client.deregisterHandler(sh.seq)
 		return
 	}
+	if atomic.LoadInt32(&sh.cancelled) == 1 {
+		return
+	}
 	select {
 	case sh.eventCh <- rec:
 	default:
@@ -332,6 +780,13 @@ func (sh *streamHandler) Handle(resp *responseHeader) {
 	}
 }
 
+// Cancel marks the handler as abandoned: later frames addressed to its seq
+// are still decoded to keep the shared decoder in sync, but are no longer
+// delivered to eventCh.
+func (sh *streamHandler) Cancel() {
+	atomic.StoreInt32(&sh.cancelled, 1)
+}
+
 func (sh *streamHandler) Cleanup() {
 	if !sh.closed {
 		if !sh.init {
@@ -345,6 +800,12 @@ func (sh *streamHandler) Cleanup() {
 
 // Stream is used to subscribe to events
 func (c *RPCClient) Stream(filter string, ch chan<- map[string]interface{}) (StreamHandle, error) {
+	return c.StreamContext(context.Background(), filter, ch)
+}
+
+// StreamContext is Stream, honoring ctx's cancellation and deadline while
+// waiting for the agent to acknowledge the subscription.
+func (c *RPCClient) StreamContext(ctx context.Context, filter string, ch chan<- map[string]interface{}) (StreamHandle, error) {
 	// Setup the request
 	seq := c.getSeq()
 	header := requestHeader{
@@ -372,17 +833,19 @@ func (c *RPCClient) Stream(filter string, ch chan<- map[string]interface{}) (Str
 	}
 
 	// Wait for a response
-	select {
-	case err := <-initCh:
-		return StreamHandle(seq), err
-	case <-c.shutdownCh:
-		c.deregisterHandler(seq)
-		return 0, clientClosed
+	if err := c.waitInit(ctx, seq, handler, initCh); err != nil {
+		return 0, err
 	}
+	return StreamHandle(seq), nil
 }
 
 // Stop is used to unsubscribe from logs or event streams
 func (c *RPCClient) Stop(handle StreamHandle) error {
+	return c.StopContext(context.Background(), handle)
+}
+
+// StopContext is Stop, honoring ctx's cancellation and deadline.
+func (c *RPCClient) StopContext(ctx context.Context, handle StreamHandle) error {
 	// Deregister locally first to stop delivery
 	c.deregisterHandler(uint64(handle))
 
@@ -393,17 +856,231 @@ func (c *RPCClient) Stop(handle StreamHandle) error {
 	req := stopRequest{
 		Stop: uint64(handle),
 	}
-	return c.genericRPC(&header, &req, nil)
+	return c.genericRPCContext(ctx, &header, &req, nil)
+}
+
+// QueryParam is used to configure a Query request
+type QueryParam struct {
+	FilterNodes []string
+	FilterTags  map[string]string
+	RequestAck  bool
+	RelayFactor uint8
+	Timeout     time.Duration
+	Name        string
+	Payload     []byte
+}
+
+// NodeResponse is a single response received for a query, carrying the
+// responding node's name and its handler's Payload. Acks are not
+// NodeResponses; they arrive on AckCh as node names.
+type NodeResponse struct {
+	From    string
+	Payload []byte
+}
+
+// QueryResponse is returned by Query and streams back acks and responses as
+// they arrive until the agent signals the query is done.
+type QueryResponse struct {
+	client *RPCClient
+	seq    uint64
+	ackCh  chan string
+	respCh chan NodeResponse
+}
+
+// AckCh returns a channel of node names that have acked the query
+func (qr *QueryResponse) AckCh() <-chan string {
+	return qr.ackCh
+}
+
+// RespCh returns a channel of responses to the query
+func (qr *QueryResponse) RespCh() <-chan NodeResponse {
+	return qr.respCh
+}
+
+// Close is used to stop listening for a query's acks and responses early,
+// sending the corresponding stop frame to the agent.
+func (qr *QueryResponse) Close() error {
+	return qr.client.Stop(StreamHandle(qr.seq))
+}
+
+type queryHandler struct {
+	client    *RPCClient
+	closed    bool
+	init      bool
+	cancelled int32
+	initCh    chan<- error
+	ackCh     chan<- string
+	respCh    chan<- NodeResponse
+	seq       uint64
+}
+
+func (qh *queryHandler) Handle(resp *responseHeader) {
+	// Initialize on the first response
+	if !qh.init {
+		qh.init = true
+		qh.initCh <- strToError(resp.Error)
+		return
+	}
+
+	// Decode query records for all other responses. This always has to run,
+	// even once cancelled, so a record the agent had already queued before it
+	// saw our cancel notification is still pulled off the shared decoder.
+	var rec queryRecord
+	if err := qh.client.dec.Decode(&rec); err != nil {
+		log.Printf("[ERR] Failed to decode query record: %v", err)
+		qh.client.deregisterHandler(qh.seq)
+		return
+	}
+
+	cancelled := atomic.LoadInt32(&qh.cancelled) == 1
+	switch rec.Type {
+	case "ack":
+		if cancelled {
+			return
+		}
+		select {
+		case qh.ackCh <- rec.From:
+		default:
+			log.Printf("[ERR] Dropping query ack! Channel full")
+		}
+	case "response":
+		if cancelled {
+			return
+		}
+		select {
+		case qh.respCh <- NodeResponse{From: rec.From, Payload: rec.Payload}:
+		default:
+			log.Printf("[ERR] Dropping query response! Channel full")
+		}
+	case "done":
+		qh.client.deregisterHandler(qh.seq)
+	default:
+		log.Printf("[ERR] Unknown query record type: %q", rec.Type)
+	}
+}
+
+// Cancel marks the handler as abandoned: later ack/response records for its
+// seq are still decoded to keep the shared decoder in sync, but are no
+// longer delivered to ackCh/respCh. The agent's "done" record still
+// deregisters the handler normally.
+func (qh *queryHandler) Cancel() {
+	atomic.StoreInt32(&qh.cancelled, 1)
+}
+
+func (qh *queryHandler) Cleanup() {
+	if !qh.closed {
+		if !qh.init {
+			qh.init = true
+			qh.initCh <- fmt.Errorf("Stream closed")
+		}
+		close(qh.ackCh)
+		close(qh.respCh)
+		qh.closed = true
+	}
+}
+
+// Query is used to send a query to the cluster and stream back the acks and
+// responses as they arrive, mirroring the UserEvent/Stream patterns.
+func (c *RPCClient) Query(params *QueryParam) (*QueryResponse, error) {
+	return c.QueryContext(context.Background(), params)
+}
+
+// QueryContext is Query, honoring ctx's cancellation and deadline while
+// waiting for the agent to acknowledge the query.
+func (c *RPCClient) QueryContext(ctx context.Context, params *QueryParam) (*QueryResponse, error) {
+	// Setup the request
+	seq := c.getSeq()
+	header := requestHeader{
+		Command: queryCommand,
+		Seq:     seq,
+	}
+	req := queryRequest{
+		FilterNodes: params.FilterNodes,
+		FilterTags:  params.FilterTags,
+		RequestAck:  params.RequestAck,
+		RelayFactor: params.RelayFactor,
+		Timeout:     params.Timeout,
+		Name:        params.Name,
+		Payload:     params.Payload,
+	}
+
+	// Create a query handler
+	initCh := make(chan error, 1)
+	ackCh := make(chan string, 128)
+	respCh := make(chan NodeResponse, 128)
+	handler := &queryHandler{
+		client: c,
+		initCh: initCh,
+		ackCh:  ackCh,
+		respCh: respCh,
+		seq:    seq,
+	}
+	c.handleSeq(seq, handler)
+
+	// Send the request
+	if err := c.send(&header, &req); err != nil {
+		c.deregisterHandler(seq)
+		return nil, err
+	}
+
+	// Wait for a response
+	if err := c.waitInit(ctx, seq, handler, initCh); err != nil {
+		return nil, err
+	}
+	return &QueryResponse{client: c, seq: seq, ackCh: ackCh, respCh: respCh}, nil
+}
+
+// Respond is used to respond to a query addressed by id, the query ID
+// surfaced on a "query" record received via Stream("query").
+func (c *RPCClient) Respond(id uint64, buf []byte) error {
+	return c.RespondContext(context.Background(), id, buf)
+}
+
+// RespondContext is Respond, honoring ctx's cancellation and deadline.
+func (c *RPCClient) RespondContext(ctx context.Context, id uint64, buf []byte) error {
+	header := requestHeader{
+		Command: respondCommand,
+		Seq:     c.getSeq(),
+	}
+	req := respondRequest{
+		ID:      id,
+		Payload: buf,
+	}
+	return c.genericRPCContext(ctx, &header, &req, nil)
 }
 
-// handshake is used to perform the initial handshake on connect
+// handshake is used to perform the initial handshake on connect. It starts
+// at maxIPCVersion and steps down until the agent accepts a version, so a
+// newer client can still talk to an older agent.
 func (c *RPCClient) handshake() error {
+	for version := int32(maxIPCVersion); version >= 1; version-- {
+		header := requestHeader{
+			Command: handshakeCommand,
+			Seq:     c.getSeq(),
+		}
+		req := handshakeRequest{
+			Version: version,
+		}
+		err := c.genericRPC(&header, &req, nil)
+		if err == nil {
+			c.remoteIPCVersion = int(version)
+			return nil
+		}
+		if err.Error() != unsupportedIPCVersion {
+			return err
+		}
+	}
+	return fmt.Errorf("client: agent does not support any known IPC version")
+}
+
+// auth is used to authenticate the connection against a hardened agent
+func (c *RPCClient) auth(key string) error {
 	header := requestHeader{
-		Command: handshakeCommand,
+		Command: authCommand,
 		Seq:     c.getSeq(),
 	}
-	req := handshakeRequest{
-		Version: maxIPCVersion,
+	req := authRequest{
+		AuthKey: key,
 	}
 	return c.genericRPC(&header, &req, nil)
 }
@@ -411,9 +1088,22 @@ func (c *RPCClient) handshake() error {
 // genericRPC is used to send a request and wait for an
 // errorSequenceResponse, potentially returning an error
 func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp interface{}) error {
-	// Setup a response handler
+	return c.genericRPCContext(context.Background(), header, req, resp)
+}
+
+// genericRPCContext is genericRPC's context-aware counterpart: it honors
+// ctx's cancellation/deadline by sending a best-effort cancel frame for
+// header.Seq so the agent can stop whatever work it was doing for this
+// request. The handler stays registered until it actually runs, rather than
+// being deregistered the moment ctx fires: the cancel frame is best-effort,
+// so the agent's real response for this seq can still arrive afterward, and
+// it must be decoded off the shared c.dec stream or every later read desyncs.
+func (c *RPCClient) genericRPCContext(ctx context.Context, header *requestHeader, req interface{}, resp interface{}) error {
+	// Setup a response handler. It deregisters itself once it runs, so a
+	// late response arriving after ctx has already fired is still drained.
 	errCh := make(chan error, 1)
 	handler := func(respHeader *responseHeader) {
+		defer c.deregisterHandler(header.Seq)
 		if resp != nil {
 			err := c.dec.Decode(resp)
 			if err != nil {
@@ -424,10 +1114,10 @@ func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp inte
 		errCh <- strToError(respHeader.Error)
 	}
 	c.handleSeq(header.Seq, &seqCallback{handler: handler})
-	defer c.deregisterHandler(header.Seq)
 
 	// Send the request
 	if err := c.send(header, req); err != nil {
+		c.deregisterHandler(header.Seq)
 		return err
 	}
 
@@ -435,7 +1125,69 @@ func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp inte
 	select {
 	case err := <-errCh:
 		return err
+	case <-ctx.Done():
+		c.cancelSeq(header.Seq)
+		return ctx.Err()
 	case <-c.shutdownCh:
+		c.deregisterHandler(header.Seq)
+		return clientClosed
+	}
+}
+
+// cancelSeq sends a best-effort "cancel" notification for seq, asking the
+// agent to stop the long-running work (a query, monitor, or join) backing
+// it. The send error is ignored: the caller has already moved on.
+func (c *RPCClient) cancelSeq(seq uint64) {
+	header := requestHeader{
+		Command: cancelCommand,
+		Seq:     c.getSeq(),
+		Type:    msgTypeNotification,
+	}
+	req := cancelRequest{Seq: seq}
+	c.send(&header, &req)
+}
+
+// abandonSeq sends the same "stop" command Stop/StopContext use to unsubscribe
+// seq, then deregisters its handler once the agent acks. It runs in its own
+// goroutine on behalf of a ctx that already fired, so a cancelled
+// Monitor/Stream/Query subscription doesn't linger in c.dispatch forever:
+// once the agent confirms it, no more frames for seq are coming, so it's
+// finally safe to remove the handler (and close its channels via Cleanup).
+func (c *RPCClient) abandonSeq(seq uint64) {
+	header := requestHeader{
+		Command: stopCommand,
+		Seq:     c.getSeq(),
+	}
+	req := stopRequest{Stop: seq}
+	if err := c.genericRPC(&header, &req, nil); err != nil {
+		log.Printf("[ERR] agent.client: Failed to stop cancelled subscription (seq %d): %v", seq, err)
+	}
+	c.deregisterHandler(seq)
+}
+
+// waitInit blocks until a stream-style handler's initCh fires, ctx is done,
+// or the client shuts down. Unlike a one-shot RPC, the agent may have
+// already queued the init ack and one or more pushes (log lines, stream
+// events, query acks) for this seq by the time ctx fires, each followed by a
+// trailing codec-encoded payload that still has to come off the shared
+// decoder. So on ctx cancellation, waitInit doesn't deregister the handler
+// itself; it marks it cancelled so Handle keeps draining and discarding
+// anything still addressed to this seq instead of delivering it to the
+// now-abandoned caller (mirroring the discard path dispatchNotification uses
+// for unregistered methods), best-effort cancels the request on the agent,
+// and hands the seq off to abandonSeq to actually unsubscribe and deregister
+// once that's confirmed safe.
+func (c *RPCClient) waitInit(ctx context.Context, seq uint64, handler seqHandler, initCh <-chan error) error {
+	select {
+	case err := <-initCh:
+		return err
+	case <-ctx.Done():
+		handler.Cancel()
+		c.cancelSeq(seq)
+		go c.abandonSeq(seq)
+		return ctx.Err()
+	case <-c.shutdownCh:
+		handler.Cancel()
 		return clientClosed
 	}
 }
@@ -508,6 +1260,11 @@ func (c *RPCClient) listen() {
 			}
 			break
 		}
+
+		if respHeader.Type == msgTypeNotification {
+			c.dispatchNotification(&respHeader)
+			continue
+		}
 		c.respondSeq(respHeader.Seq, &respHeader)
 	}
 }
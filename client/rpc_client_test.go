@@ -0,0 +1,457 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/logutils"
+	"github.com/ugorji/go/codec"
+)
+
+func TestSplitMethod(t *testing.T) {
+	cases := []struct {
+		in        string
+		namespace string
+		name      string
+	}{
+		{"demo.Ping", "demo", "Ping"},
+		{"a.b.Ping", "a.b", "Ping"},
+		{"Ping", "", "Ping"},
+		{"", "", ""},
+	}
+
+	for _, tc := range cases {
+		namespace, name := splitMethod(tc.in)
+		if namespace != tc.namespace || name != tc.name {
+			t.Errorf("splitMethod(%q) = (%q, %q), want (%q, %q)",
+				tc.in, namespace, name, tc.namespace, tc.name)
+		}
+	}
+}
+
+type pingArgs struct {
+	Msg string
+}
+
+type validService struct{}
+
+func (s *validService) Ping(ctx context.Context, args *pingArgs) error {
+	return nil
+}
+
+type noMethodsService struct{}
+
+type wrongSignatureService struct{}
+
+// Missing the context.Context parameter, so this method isn't usable.
+func (s *wrongSignatureService) Ping(args *pingArgs) error {
+	return nil
+}
+
+func TestRegisterName(t *testing.T) {
+	c := &RPCClient{}
+	if err := c.RegisterName("demo", &validService{}); err != nil {
+		t.Fatalf("RegisterName with a valid service returned an error: %v", err)
+	}
+	if _, ok := c.services["demo"]["Ping"]; !ok {
+		t.Fatalf("expected demo.Ping to be registered")
+	}
+
+	if err := c.RegisterName("empty", &noMethodsService{}); err == nil {
+		t.Fatalf("expected RegisterName to reject a service with no usable methods")
+	}
+
+	if err := c.RegisterName("bad", &wrongSignatureService{}); err == nil {
+		t.Fatalf("expected RegisterName to reject a method missing the context.Context parameter")
+	}
+}
+
+// msgpackHandle mirrors the codec handle ClientFromConfig wires up, so the
+// fake agent in the CancelDrainsLateFrames tests below speaks the same wire
+// format as the real client.
+var msgpackHandle = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+
+// newLoopbackClient wires up an RPCClient directly over one end of a
+// net.Pipe, skipping the handshake/auth exchange that ClientFromConfig does,
+// so the test can drive the wire protocol from the other end by hand.
+func newLoopbackClient(conn net.Conn) *RPCClient {
+	c := &RPCClient{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		dispatch:   make(map[uint64]seqHandler),
+		shutdownCh: make(chan struct{}),
+	}
+	c.dec = codec.NewDecoder(c.reader, msgpackHandle)
+	c.enc = codec.NewEncoder(c.writer, msgpackHandle)
+	go c.listen()
+	return c
+}
+
+// decodeRequest decodes a request header and body off dec and fails the test
+// if the header's command doesn't match want.
+func decodeRequest(t *testing.T, dec *codec.Decoder, want string, body interface{}) requestHeader {
+	t.Helper()
+	var header requestHeader
+	if err := dec.Decode(&header); err != nil {
+		t.Fatalf("agent failed to decode %s request header: %v", want, err)
+	}
+	if err := dec.Decode(body); err != nil {
+		t.Fatalf("agent failed to decode %s request body: %v", want, err)
+	}
+	if header.Command != want {
+		t.Fatalf("expected a %s request, got %+v", want, header)
+	}
+	return header
+}
+
+// TestMonitorContextCancelDrainsLateFrames reproduces the race from 6d2181a
+// for waitInit on the Monitor path: the agent can have already queued a log
+// record for a seq by the time our cancel notification reaches it.
+// MonitorContext must keep draining those records instead of leaving them on
+// the shared decoder, and a later RPC on the same connection must still
+// succeed.
+func TestMonitorContextCancelDrainsLateFrames(t *testing.T) {
+	clientConn, agentConn := net.Pipe()
+	defer agentConn.Close()
+
+	c := newLoopbackClient(clientConn)
+	defer c.Close()
+
+	agentDec := codec.NewDecoder(agentConn, msgpackHandle)
+	agentEnc := codec.NewEncoder(agentConn, msgpackHandle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	monitorDone := make(chan error, 1)
+	logCh := make(chan string, 1)
+	go func() {
+		_, err := c.MonitorContext(ctx, logutils.LogLevel("DEBUG"), logCh)
+		monitorDone <- err
+	}()
+
+	var monitorReq monitorRequest
+	monitorReqHeader := decodeRequest(t, agentDec, monitorCommand, &monitorReq)
+
+	// Cancel before the agent acks, and read off the best-effort cancel
+	// notification it unblocks, mirroring a deadline firing mid-subscribe.
+	cancel()
+	var cancelReq cancelRequest
+	cancelReqHeader := decodeRequest(t, agentDec, cancelCommand, &cancelReq)
+	if cancelReq.Seq != monitorReqHeader.Seq {
+		t.Fatalf("unexpected cancel notification: %+v %+v", cancelReqHeader, cancelReq)
+	}
+
+	select {
+	case err := <-monitorDone:
+		if err != context.Canceled {
+			t.Fatalf("MonitorContext returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("MonitorContext did not return after ctx cancellation")
+	}
+
+	// waitInit also hands the seq off to abandonSeq, which unsubscribes it
+	// with the same "stop" command Stop/StopContext use. Read that request
+	// but don't answer it yet: the monitor's handler must stay registered
+	// and keep draining frames until this stop is acked, so read it off
+	// first.
+	var stopReq stopRequest
+	stopReqHeader := decodeRequest(t, agentDec, stopCommand, &stopReq)
+	if stopReq.Stop != monitorReqHeader.Seq {
+		t.Fatalf("unexpected stop request: %+v %+v", stopReqHeader, stopReq)
+	}
+
+	// Simulate the agent having already queued the init ack plus one log
+	// record for this seq before it processed our cancel notification and
+	// the stop request above.
+	if err := agentEnc.Encode(&responseHeader{Seq: monitorReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late ack: %v", err)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: monitorReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late record header: %v", err)
+	}
+	if err := agentEnc.Encode(&logRecord{Log: "late log line"}); err != nil {
+		t.Fatalf("agent failed to send late record body: %v", err)
+	}
+
+	// Now ack the stop, letting abandonSeq deregister the monitor's handler.
+	if err := agentEnc.Encode(&responseHeader{Seq: stopReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send stop response: %v", err)
+	}
+
+	// A later RPC on the same connection must still succeed: if the late
+	// frames above desynced the shared decoder, this either errors out or
+	// hangs until the test's own timeout.
+	leaveDone := make(chan error, 1)
+	go func() { leaveDone <- c.Leave() }()
+
+	var leaveReqHeader requestHeader
+	if err := agentDec.Decode(&leaveReqHeader); err != nil {
+		t.Fatalf("agent failed to decode leave request header: %v", err)
+	}
+	if leaveReqHeader.Command != leaveCommand {
+		t.Fatalf("expected a leave request, got %+v", leaveReqHeader)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: leaveReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send leave response: %v", err)
+	}
+
+	select {
+	case err := <-leaveDone:
+		if err != nil {
+			t.Fatalf("Leave after cancelled monitor returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Leave did not return; the decoder is likely desynced")
+	}
+
+	// The cancelled monitor's handler must not linger in c.dispatch once its
+	// stop was acked, or it leaks for the life of the connection.
+	c.dispatchLock.Lock()
+	_, stillRegistered := c.dispatch[monitorReqHeader.Seq]
+	c.dispatchLock.Unlock()
+	if stillRegistered {
+		t.Fatalf("monitor handler for seq %d is still registered after its stop was acked", monitorReqHeader.Seq)
+	}
+}
+
+// TestStreamContextCancelDrainsLateFrames is TestMonitorContextCancelDrainsLateFrames,
+// but for the Stream path: the agent can have already queued an event record
+// for a seq by the time our cancel notification reaches it, and
+// StreamContext must keep draining those records instead of desyncing the
+// shared decoder.
+func TestStreamContextCancelDrainsLateFrames(t *testing.T) {
+	clientConn, agentConn := net.Pipe()
+	defer agentConn.Close()
+
+	c := newLoopbackClient(clientConn)
+	defer c.Close()
+
+	agentDec := codec.NewDecoder(agentConn, msgpackHandle)
+	agentEnc := codec.NewEncoder(agentConn, msgpackHandle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streamDone := make(chan error, 1)
+	eventCh := make(chan map[string]interface{}, 1)
+	go func() {
+		_, err := c.StreamContext(ctx, "*", eventCh)
+		streamDone <- err
+	}()
+
+	var streamReq streamRequest
+	streamReqHeader := decodeRequest(t, agentDec, streamCommand, &streamReq)
+
+	// Cancel before the agent acks, and read off the best-effort cancel
+	// notification it unblocks, mirroring a deadline firing mid-subscribe.
+	cancel()
+	var cancelReq cancelRequest
+	cancelReqHeader := decodeRequest(t, agentDec, cancelCommand, &cancelReq)
+	if cancelReq.Seq != streamReqHeader.Seq {
+		t.Fatalf("unexpected cancel notification: %+v %+v", cancelReqHeader, cancelReq)
+	}
+
+	select {
+	case err := <-streamDone:
+		if err != context.Canceled {
+			t.Fatalf("StreamContext returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StreamContext did not return after ctx cancellation")
+	}
+
+	// waitInit also hands the seq off to abandonSeq, which unsubscribes it
+	// with the same "stop" command Stop/StopContext use. Read that request
+	// but don't answer it yet: the stream's handler must stay registered and
+	// keep draining frames until this stop is acked, so read it off first.
+	var stopReq stopRequest
+	stopReqHeader := decodeRequest(t, agentDec, stopCommand, &stopReq)
+	if stopReq.Stop != streamReqHeader.Seq {
+		t.Fatalf("unexpected stop request: %+v %+v", stopReqHeader, stopReq)
+	}
+
+	// Simulate the agent having already queued the init ack plus one event
+	// record for this seq before it processed our cancel notification and
+	// the stop request above.
+	if err := agentEnc.Encode(&responseHeader{Seq: streamReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late ack: %v", err)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: streamReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late record header: %v", err)
+	}
+	if err := agentEnc.Encode(map[string]interface{}{"Event": "member-join"}); err != nil {
+		t.Fatalf("agent failed to send late record body: %v", err)
+	}
+
+	// Now ack the stop, letting abandonSeq deregister the stream's handler.
+	if err := agentEnc.Encode(&responseHeader{Seq: stopReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send stop response: %v", err)
+	}
+
+	// A later RPC on the same connection must still succeed: if the late
+	// frames above desynced the shared decoder, this either errors out or
+	// hangs until the test's own timeout.
+	leaveDone := make(chan error, 1)
+	go func() { leaveDone <- c.Leave() }()
+
+	var leaveReqHeader requestHeader
+	if err := agentDec.Decode(&leaveReqHeader); err != nil {
+		t.Fatalf("agent failed to decode leave request header: %v", err)
+	}
+	if leaveReqHeader.Command != leaveCommand {
+		t.Fatalf("expected a leave request, got %+v", leaveReqHeader)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: leaveReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send leave response: %v", err)
+	}
+
+	select {
+	case err := <-leaveDone:
+		if err != nil {
+			t.Fatalf("Leave after cancelled stream returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Leave did not return; the decoder is likely desynced")
+	}
+
+	// The cancelled stream's handler must not linger in c.dispatch once its
+	// stop was acked, or it leaks for the life of the connection.
+	c.dispatchLock.Lock()
+	_, stillRegistered := c.dispatch[streamReqHeader.Seq]
+	c.dispatchLock.Unlock()
+	if stillRegistered {
+		t.Fatalf("stream handler for seq %d is still registered after its stop was acked", streamReqHeader.Seq)
+	}
+}
+
+// TestQueryContextCancelDrainsLateFrames reproduces the race from 6d2181a
+// for waitInit: the agent can have already queued the query ack and a record
+// for a seq by the time our cancel notification reaches it. QueryContext
+// must not desync the shared decoder in that case, and a later RPC on the
+// same connection must still succeed. queryRecord is a deliberately awkward
+// choice of orphaned payload: its "Type" field is a string, while
+// responseHeader's "Type" field is a uint8, so decoding one as the other (as
+// happens when the trailing payload is left undrained) is a genuine,
+// unrecoverable decode error, not just a harmless mismatched read.
+func TestQueryContextCancelDrainsLateFrames(t *testing.T) {
+	clientConn, agentConn := net.Pipe()
+	defer agentConn.Close()
+
+	c := newLoopbackClient(clientConn)
+	defer c.Close()
+
+	agentDec := codec.NewDecoder(agentConn, msgpackHandle)
+	agentEnc := codec.NewEncoder(agentConn, msgpackHandle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queryDone := make(chan error, 1)
+	go func() {
+		_, err := c.QueryContext(ctx, &QueryParam{Name: "test"})
+		queryDone <- err
+	}()
+
+	// Read the query request the client sent.
+	var queryReqHeader requestHeader
+	if err := agentDec.Decode(&queryReqHeader); err != nil {
+		t.Fatalf("agent failed to decode query request header: %v", err)
+	}
+	var queryReq queryRequest
+	if err := agentDec.Decode(&queryReq); err != nil {
+		t.Fatalf("agent failed to decode query request body: %v", err)
+	}
+
+	// Cancel before the agent acks, and read off the best-effort cancel
+	// notification it unblocks, mirroring a deadline firing mid-query.
+	cancel()
+	var cancelReqHeader requestHeader
+	if err := agentDec.Decode(&cancelReqHeader); err != nil {
+		t.Fatalf("agent failed to decode cancel notification header: %v", err)
+	}
+	var cancelReq cancelRequest
+	if err := agentDec.Decode(&cancelReq); err != nil {
+		t.Fatalf("agent failed to decode cancel notification body: %v", err)
+	}
+	if cancelReqHeader.Command != cancelCommand || cancelReq.Seq != queryReqHeader.Seq {
+		t.Fatalf("unexpected cancel notification: %+v %+v", cancelReqHeader, cancelReq)
+	}
+
+	select {
+	case err := <-queryDone:
+		if err != context.Canceled {
+			t.Fatalf("QueryContext returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("QueryContext did not return after ctx cancellation")
+	}
+
+	// waitInit also hands the seq off to abandonSeq, which unsubscribes it
+	// with the same "stop" command Stop/StopContext use. Read that request
+	// but don't answer it yet: the query's handler must stay registered and
+	// keep draining frames until this stop is acked, so read it off first.
+	var stopReqHeader requestHeader
+	if err := agentDec.Decode(&stopReqHeader); err != nil {
+		t.Fatalf("agent failed to decode stop request header: %v", err)
+	}
+	var stopReq stopRequest
+	if err := agentDec.Decode(&stopReq); err != nil {
+		t.Fatalf("agent failed to decode stop request body: %v", err)
+	}
+	if stopReqHeader.Command != stopCommand || stopReq.Stop != queryReqHeader.Seq {
+		t.Fatalf("unexpected stop request: %+v %+v", stopReqHeader, stopReq)
+	}
+
+	// Simulate the agent having already queued the ack plus one ack record
+	// for this seq before it processed our cancel notification and the stop
+	// request above.
+	if err := agentEnc.Encode(&responseHeader{Seq: queryReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late ack: %v", err)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: queryReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send late record header: %v", err)
+	}
+	if err := agentEnc.Encode(&queryRecord{Type: "ack", From: "node1"}); err != nil {
+		t.Fatalf("agent failed to send late record body: %v", err)
+	}
+
+	// Now ack the stop, letting abandonSeq deregister the query's handler.
+	if err := agentEnc.Encode(&responseHeader{Seq: stopReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send stop response: %v", err)
+	}
+
+	// A later RPC on the same connection must still succeed: if the late
+	// frames above desynced the shared decoder, this either errors out or
+	// hangs until the test's own timeout.
+	leaveDone := make(chan error, 1)
+	go func() { leaveDone <- c.Leave() }()
+
+	var leaveReqHeader requestHeader
+	if err := agentDec.Decode(&leaveReqHeader); err != nil {
+		t.Fatalf("agent failed to decode leave request header: %v", err)
+	}
+	if leaveReqHeader.Command != leaveCommand {
+		t.Fatalf("expected a leave request, got %+v", leaveReqHeader)
+	}
+	if err := agentEnc.Encode(&responseHeader{Seq: leaveReqHeader.Seq, Type: msgTypeResponse}); err != nil {
+		t.Fatalf("agent failed to send leave response: %v", err)
+	}
+
+	select {
+	case err := <-leaveDone:
+		if err != nil {
+			t.Fatalf("Leave after cancelled query returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Leave did not return; the decoder is likely desynced")
+	}
+
+	// The cancelled query's handler must not linger in c.dispatch once its
+	// stop was acked, or it leaks for the life of the connection.
+	c.dispatchLock.Lock()
+	_, stillRegistered := c.dispatch[queryReqHeader.Seq]
+	c.dispatchLock.Unlock()
+	if stillRegistered {
+		t.Fatalf("query handler for seq %d is still registered after its stop was acked", queryReqHeader.Seq)
+	}
+}